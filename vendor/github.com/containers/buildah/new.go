@@ -4,19 +4,20 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"os"
 	"strings"
 	"time"
 
-	"github.com/containers/buildah/util"
+	"github.com/containers/buildah/pkg/imageresolver"
 	"github.com/containers/image/v5/image"
 	"github.com/containers/image/v5/manifest"
-	"github.com/containers/image/v5/pkg/sysregistriesv2"
 	is "github.com/containers/image/v5/storage"
 	"github.com/containers/image/v5/transports"
-	"github.com/containers/image/v5/transports/alltransports"
 	"github.com/containers/image/v5/types"
 	"github.com/containers/storage"
 	digest "github.com/opencontainers/go-digest"
+	selinux "github.com/opencontainers/selinux/go-selinux"
+	"github.com/opencontainers/selinux/go-selinux/label"
 	"github.com/openshift/imagebuilder"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -28,28 +29,6 @@ const (
 	BaseImageFakeName = imagebuilder.NoBaseImageSpecifier
 )
 
-func pullAndFindImage(ctx context.Context, store storage.Store, srcRef types.ImageReference, options BuilderOptions, sc *types.SystemContext) (*storage.Image, types.ImageReference, error) {
-	pullOptions := PullOptions{
-		ReportWriter:  options.ReportWriter,
-		Store:         store,
-		SystemContext: options.SystemContext,
-		BlobDirectory: options.BlobDirectory,
-		MaxRetries:    options.MaxPullRetries,
-		RetryDelay:    options.PullRetryDelay,
-	}
-	ref, err := pullImage(ctx, store, srcRef, pullOptions, sc)
-	if err != nil {
-		logrus.Debugf("error pulling image %q: %v", transports.ImageName(srcRef), err)
-		return nil, nil, err
-	}
-	img, err := is.Transport.GetStoreImage(store, ref)
-	if err != nil {
-		logrus.Debugf("error reading pulled image %q: %v", transports.ImageName(srcRef), err)
-		return nil, nil, errors.Wrapf(err, "error locating image %q in local storage", transports.ImageName(ref))
-	}
-	return img, ref, nil
-}
-
 func getImageName(name string, img *storage.Image) string {
 	imageName := name
 	if len(img.Names) > 0 {
@@ -59,7 +38,7 @@ func getImageName(name string, img *storage.Image) string {
 		// the image given in the "from" command line.
 		// This loop is supposed to fix this.
 		for _, n := range img.Names {
-			if strings.Contains(n, name) {
+			if imageresolver.Matches(n, name) {
 				imageName = n
 				break
 			}
@@ -102,145 +81,83 @@ func newContainerIDMappingOptions(idmapOptions *IDMappingOptions) storage.IDMapp
 	return options
 }
 
-func resolveImage(ctx context.Context, systemContext *types.SystemContext, store storage.Store, options BuilderOptions) (types.ImageReference, string, *storage.Image, error) {
-	type failure struct {
-		resolvedImageName string
-		err               error
-	}
-	candidates, transport, searchRegistriesWereUsedButEmpty, err := util.ResolveName(options.FromImage, options.Registry, systemContext, store)
-	if err != nil {
-		return nil, "", nil, errors.Wrapf(err, "error parsing reference to image %q", options.FromImage)
+// convertPullPolicy adapts a buildah PullPolicy to the equivalent
+// imageresolver.PullPolicy, so that newBuilder can hand BuilderOptions'
+// policy straight to the resolver subsystem without it needing to import
+// the buildah package.
+func convertPullPolicy(policy PullPolicy) imageresolver.PullPolicy {
+	switch policy {
+	case PullAlways:
+		return imageresolver.PullAlways
+	case PullIfNewer:
+		return imageresolver.PullIfNewer
+	case PullNever:
+		return imageresolver.PullNever
+	default:
+		return imageresolver.PullIfMissing
 	}
+}
 
-	failures := []failure{}
-	for _, image := range candidates {
-		if transport == "" {
-			img, err := store.Image(image)
-			if err != nil {
-				logrus.Debugf("error looking up known-local image %q: %v", image, err)
-				failures = append(failures, failure{resolvedImageName: image, err: err})
-				continue
-			}
-			ref, err := is.Transport.ParseStoreReference(store, img.ID)
-			if err != nil {
-				return nil, "", nil, errors.Wrapf(err, "error parsing reference to image %q", img.ID)
-			}
-			return ref, transport, img, nil
-		}
+// retryMaxDelayMultiple bounds how far convertRetryPolicy lets a single
+// delay grow relative to options.PullRetryDelay: enough doublings to spread
+// attempts out before capping, without letting a single long-MaxPullRetries
+// caller wait arbitrarily long between attempts.
+const retryMaxDelayMultiple = 8
+
+// convertRetryPolicy builds an imageresolver.RetryPolicy from
+// BuilderOptions' existing MaxPullRetries/PullRetryDelay pair. Rather than
+// retrying at a flat PullRetryDelay as before, it grows the delay
+// exponentially (capped at retryMaxDelayMultiple times PullRetryDelay) and
+// jitters it, so that the backoff imageresolver.RetryPolicy now supports
+// actually reaches callers instead of only being reachable by callers that
+// construct a RetryPolicy directly.
+func convertRetryPolicy(options BuilderOptions) imageresolver.RetryPolicy {
+	if options.MaxPullRetries <= 0 {
+		return imageresolver.RetryPolicy{}
+	}
+	delay := options.PullRetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	return imageresolver.RetryPolicy{
+		MaxRetries:   options.MaxPullRetries,
+		InitialDelay: delay,
+		MaxDelay:     delay * retryMaxDelayMultiple,
+		Multiplier:   2,
+		Jitter:       true,
+	}
+}
 
-		trans := transport
-		if transport != util.DefaultTransport {
-			trans = trans + ":"
-		}
-		srcRef, err := alltransports.ParseImageName(trans + image)
-		if err != nil {
-			logrus.Debugf("error parsing image name %q: %v", trans+image, err)
-			failures = append(failures, failure{
-				resolvedImageName: image,
-				err:               errors.Wrapf(err, "error parsing attempted image name %q", trans+image),
-			})
+// reserveSELinuxLabels makes sure that the labels being reserved are not
+// already assigned to a container. If a container is already using the
+// label, a new unique label will be generated.
+func reserveSELinuxLabels(store storage.Store, id string) error {
+	if !selinux.GetEnabled() {
+		return nil
+	}
+	containers, err := store.Containers()
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		if container.ID == id {
+			// Skip our own container, if we already have one.
 			continue
 		}
 
-		if options.PullPolicy == PullAlways {
-			pulledImg, pulledReference, err := pullAndFindImage(ctx, store, srcRef, options, systemContext)
-			if err != nil {
-				logrus.Debugf("unable to pull and read image %q: %v", image, err)
-				failures = append(failures, failure{resolvedImageName: image, err: err})
-				continue
-			}
-			return pulledReference, transport, pulledImg, nil
-		}
-
-		destImage, err := localImageNameForReference(ctx, store, srcRef)
-		if err != nil {
-			return nil, "", nil, errors.Wrapf(err, "error computing local image name for %q", transports.ImageName(srcRef))
-		}
-		if destImage == "" {
-			return nil, "", nil, errors.Errorf("error computing local image name for %q", transports.ImageName(srcRef))
-		}
-		ref, err := is.Transport.ParseStoreReference(store, destImage)
+		b, err := OpenBuilder(store, container.ID)
 		if err != nil {
-			return nil, "", nil, errors.Wrapf(err, "error parsing reference to image %q", destImage)
-		}
-
-		if options.PullPolicy == PullIfNewer {
-			img, err := is.Transport.GetStoreImage(store, ref)
-			if err == nil {
-				// Let's see if this image is on the repository and if it's there
-				// then note it's Created date.
-				var repoImageCreated time.Time
-				repoImageFound := false
-				repoImage, err := srcRef.NewImage(ctx, systemContext)
-				if err == nil {
-					inspect, err := repoImage.Inspect(ctx)
-					if err == nil {
-						repoImageFound = true
-						repoImageCreated = *inspect.Created
-					}
-					repoImage.Close()
-				}
-				if !repoImageFound || repoImageCreated == img.Created {
-					// The image is only local or the same date is on the
-					// local and repo versions of the image, no need to pull.
-					return ref, transport, img, nil
-				}
-			}
-		} else {
-			// Get the image from the store if present for PullNever and PullIfMissing
-			img, err := is.Transport.GetStoreImage(store, ref)
-			if err == nil {
-				return ref, transport, img, nil
-			}
-			if errors.Cause(err) == storage.ErrImageUnknown && options.PullPolicy == PullNever {
-				logrus.Debugf("no such image %q: %v", transports.ImageName(ref), err)
-				failures = append(failures, failure{
-					resolvedImageName: image,
-					err:               errors.Errorf("no such image %q", transports.ImageName(ref)),
-				})
+			if os.IsNotExist(errors.Cause(err)) {
+				// Ignore not-exist errors: a container without a build
+				// state was probably created by some other tool and
+				// has no label of its own to reserve.
 				continue
 			}
+			return err
 		}
-
-		pulledImg, pulledReference, err := pullAndFindImage(ctx, store, srcRef, options, systemContext)
-		if err != nil {
-			logrus.Debugf("unable to pull and read image %q: %v", image, err)
-			failures = append(failures, failure{resolvedImageName: image, err: err})
-			continue
-		}
-		return pulledReference, transport, pulledImg, nil
-	}
-
-	if len(failures) != len(candidates) {
-		return nil, "", nil, errors.Errorf("internal error: %d candidates (%#v) vs. %d failures (%#v)", len(candidates), candidates, len(failures), failures)
-	}
-
-	registriesConfPath := sysregistriesv2.ConfigPath(systemContext)
-	switch len(failures) {
-	case 0:
-		if searchRegistriesWereUsedButEmpty {
-			return nil, "", nil, errors.Errorf("image name %q is a short name and no search registries are defined in %s.", options.FromImage, registriesConfPath)
-		}
-		return nil, "", nil, errors.Errorf("internal error: no pull candidates were available for %q for an unknown reason", options.FromImage)
-
-	case 1:
-		err := failures[0].err
-		if failures[0].resolvedImageName != options.FromImage {
-			err = errors.Wrapf(err, "while pulling %q as %q", options.FromImage, failures[0].resolvedImageName)
-		}
-		if searchRegistriesWereUsedButEmpty {
-			err = errors.Wrapf(err, "(image name %q is a short name and no search registries are defined in %s)", options.FromImage, registriesConfPath)
-		}
-		return nil, "", nil, err
-
-	default:
-		// NOTE: a multi-line error string:
-		e := fmt.Sprintf("The following failures happened while trying to pull image specified by %q based on search registries in %s:", options.FromImage, registriesConfPath)
-		for _, f := range failures {
-			e = e + fmt.Sprintf("\n* %q: %s", f.resolvedImageName, f.err.Error())
-		}
-		return nil, "", nil, errors.New(e)
+		label.ReserveLabel(b.ProcessLabel)
 	}
+	return nil
 }
 
 func containerNameExist(name string, containers []storage.Container) bool {
@@ -277,10 +194,23 @@ func newBuilder(ctx context.Context, store storage.Store, options BuilderOptions
 	systemContext := getSystemContext(store, options.SystemContext, options.SignaturePolicyPath)
 
 	if options.FromImage != "" && options.FromImage != "scratch" {
-		ref, _, img, err = resolveImage(ctx, systemContext, store, options)
+		runtime := imageresolver.NewRuntime(store, systemContext)
+		var resolved *imageresolver.Image
+		resolved, err = runtime.Resolve(ctx, options.FromImage, imageresolver.ResolveOptions{
+			PullPolicy:    convertPullPolicy(options.PullPolicy),
+			Registry:      options.Registry,
+			BlobDirectory: options.BlobDirectory,
+			ReportWriter:  options.ReportWriter,
+			RetryPolicy:   convertRetryPolicy(options),
+		})
 		if err != nil {
 			return nil, err
 		}
+		img = resolved.Image
+		ref, err = is.Transport.ParseStoreReference(store, resolved.ID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing reference to image %q", resolved.ID)
+		}
 	}
 	imageSpec := options.FromImage
 	imageID := ""
@@ -341,6 +271,10 @@ func newBuilder(ctx context.Context, store storage.Store, options BuilderOptions
 		tmpName = findUnusedContainer(tmpName, containers)
 	}
 
+	if err := reserveSELinuxLabels(store, ""); err != nil {
+		return nil, err
+	}
+
 	conflict := 100
 	for {
 		coptions := storage.ContainerOptions{
@@ -363,6 +297,7 @@ func newBuilder(ctx context.Context, store storage.Store, options BuilderOptions
 			if err2 := store.DeleteContainer(container.ID); err2 != nil {
 				logrus.Errorf("error deleting container %q: %v", container.ID, err2)
 			}
+			label.ReleaseLabel(container.ProcessLabel())
 		}
 	}()
 
@@ -0,0 +1,16 @@
+package imageresolver
+
+import "github.com/pkg/errors"
+
+var (
+	// ErrNoSuchImage is the cause of the error returned when no local
+	// image matches a lookup, when PullNever finds no local copy, and
+	// when Resolve has no candidates or more than one candidate failed.
+	// When Resolve had exactly one candidate and it failed, that
+	// candidate's own error is returned instead.
+	ErrNoSuchImage = errors.New("no such image")
+	// ErrShortNameAmbiguous is the cause of the error returned when a
+	// name without a "/" matches images from more than one repository
+	// in local storage.
+	ErrShortNameAmbiguous = errors.New("short name is ambiguous")
+)
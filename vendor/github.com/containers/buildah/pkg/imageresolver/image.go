@@ -0,0 +1,48 @@
+package imageresolver
+
+import (
+	"github.com/containers/storage"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Platform identifies the OS/architecture/variant that an Image was
+// resolved for, mirroring the fields of a containers/image v5 platform
+// specifier without requiring callers to import it just to read them back.
+type Platform struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+// Image is the result of a successful lookup, pull, or resolve. It embeds
+// the underlying *storage.Image so callers that only care about ID, Names,
+// or TopLayer can keep using the fields they already know, while the extra
+// fields give callers that need them the manifest digest, the platform the
+// image was pulled for, and its place in the local image graph.
+type Image struct {
+	*storage.Image
+
+	// Digest is the manifest digest of the instance that was actually
+	// selected, which for a multi-arch image is the per-platform
+	// instance digest, not the list digest.
+	Digest digest.Digest
+	// Platform is the OS/architecture/variant that the image was looked
+	// up or pulled for: the caller's requested Platform if one was given,
+	// otherwise the SystemContext's OS/architecture/variant choices, with
+	// OS "linux" when the SystemContext sets none. It is not read from
+	// the image's own configuration, and fields that neither source sets
+	// are left empty.
+	Platform Platform
+	// ParentID is the ID of the local image whose top layer is the
+	// parent of this image's top layer, if any.
+	ParentID string
+	// Children holds the IDs of local images whose top layer's parent
+	// is this image's top layer.
+	Children []string
+	// NamesHistory records every name this image has ever been known
+	// by, including ones that Names no longer lists because a newer
+	// pull moved them onto a different image, so that a caller trying
+	// to explain what happened to an old tag doesn't have to go back to
+	// image storage itself.
+	NamesHistory []string
+}
@@ -0,0 +1,122 @@
+// Package imageresolver implements image lookup, pulling, and short-name
+// resolution as a standalone subsystem, in the same spirit as Podman's
+// containers/common/libimage. It exists so that the candidate search,
+// pull-policy handling, and progress reporting that "buildah from" needs
+// can be reused by other callers - in particular CRI-O's image service -
+// instead of being duplicated or re-implemented against the Builder type.
+package imageresolver
+
+import (
+	"io"
+
+	"github.com/containers/image/v5/types"
+	"github.com/containers/storage"
+)
+
+// PullPolicy controls whether and when Resolve is willing to contact a
+// registry for a named image. It mirrors buildah.PullPolicy so that
+// callers outside of the buildah package don't need to import it just to
+// select a policy.
+type PullPolicy int
+
+const (
+	// PullIfMissing pulls an image only if it can't be found locally.
+	PullIfMissing PullPolicy = iota
+	// PullAlways pulls an image even if a local copy is present.
+	PullAlways
+	// PullIfNewer pulls if the remote image differs from the one in
+	// local storage, determined by comparing manifest digests.
+	PullIfNewer
+	// PullNever never pulls, and fails if no local copy is present.
+	PullNever
+)
+
+// Event is sent on a ResolveOptions or PullOptions Report channel, if one
+// is supplied, as each pull candidate is attempted, so that a caller can
+// surface progress without scraping debug logs. Sending never blocks: an
+// Event that the channel cannot accept at once is dropped.
+type Event struct {
+	// Candidate is the name currently being tried.
+	Candidate string
+	// Message is a short human-readable description of what happened.
+	Message string
+	// Err is set when Candidate could not be used.
+	Err error
+}
+
+// LookupOptions controls LookupImage.
+type LookupOptions struct {
+	// Platform, if set, restricts a multi-arch match to the given
+	// OS/architecture/variant.
+	Platform *Platform
+}
+
+// PullOptions controls Pull.
+type PullOptions struct {
+	// Platform, if set, selects a single instance out of a manifest
+	// list instead of the one that matches the local host.
+	Platform *Platform
+	// BlobDirectory is an optional on-disk blob cache, as accepted by
+	// the rest of the buildah pull path.
+	BlobDirectory string
+	// ReportWriter, if set, receives the same human-readable progress
+	// text that buildah's own pull path writes today, plus a line for
+	// every retried attempt.
+	ReportWriter io.Writer
+	// Report, if set, additionally receives a structured Event for
+	// every retried attempt and for the final outcome of the pull.
+	Report chan<- Event
+	// RetryPolicy controls the backoff between attempts. The zero value
+	// performs no retries, matching Pull's behavior before backoff was
+	// introduced; see DefaultRetryPolicy for the common MaxRetries/delay
+	// shape, or set the RetryPolicy fields directly for backoff.
+	RetryPolicy RetryPolicy
+}
+
+// ResolveOptions controls Resolve.
+type ResolveOptions struct {
+	// Platform, if set, restricts matches to the given
+	// OS/architecture/variant instead of the local host's.
+	Platform *Platform
+	// PullPolicy decides whether and when a registry is consulted.
+	PullPolicy PullPolicy
+	// Registry, if set, is tried ahead of the configured search
+	// registries, exactly as BuilderOptions.Registry does today.
+	Registry string
+	// BlobDirectory is forwarded to Pull when a pull is needed.
+	BlobDirectory string
+	// ReportWriter is forwarded to Pull when a pull is needed.
+	ReportWriter io.Writer
+	// Report, if set, receives a structured Event for each candidate
+	// that Resolve tries, whether or not a pull was needed.
+	Report chan<- Event
+	// RetryPolicy is forwarded to Pull when a pull is needed.
+	RetryPolicy RetryPolicy
+}
+
+// Runtime resolves, looks up, and pulls images on behalf of a single
+// storage.Store. It holds no state beyond the store and the SystemContext
+// that candidate lookups should use, so it's cheap to construct per call.
+type Runtime struct {
+	store         storage.Store
+	systemContext *types.SystemContext
+}
+
+// NewRuntime returns a Runtime that resolves images against store, using
+// systemContext for registry access, blob caching, and signature policy.
+func NewRuntime(store storage.Store, systemContext *types.SystemContext) *Runtime {
+	return &Runtime{
+		store:         store,
+		systemContext: systemContext,
+	}
+}
+
+func (r *Runtime) reportf(report chan<- Event, candidate, message string, err error) {
+	if report == nil {
+		return
+	}
+	select {
+	case report <- Event{Candidate: candidate, Message: message, Err: err}:
+	default:
+	}
+}
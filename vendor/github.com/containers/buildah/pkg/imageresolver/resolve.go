@@ -0,0 +1,554 @@
+package imageresolver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containers/buildah/util"
+	cp "github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobcache"
+	"github.com/containers/image/v5/signature"
+	is "github.com/containers/image/v5/storage"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/containers/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Matches reports whether candidate (one of an image's recorded names)
+// refers to the same repository as name, matching on a full repository
+// path suffix at a "/" boundary rather than a raw substring, so that a
+// request for "foo" can't be satisfied by "myfoo" or
+// "registry.example.com/team/myfoo". If name carries a tag or digest,
+// candidate must carry the identical tag or digest.
+func Matches(candidate, name string) bool {
+	candidateRef, err := reference.ParseNormalizedNamed(candidate)
+	if err != nil {
+		return candidate == name
+	}
+	nameRef, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return candidate == name
+	}
+
+	candidateRepo := reference.Path(candidateRef)
+	nameRepo := reference.Path(nameRef)
+	if !strings.Contains(name, "/") {
+		// ParseNormalizedNamed treats a bare, slash-free name as an
+		// unqualified Docker Hub official repository and silently
+		// rewrites it to "library/<name>". name carries no registry
+		// or org information of its own here, so undo that rewrite
+		// and compare against candidate's actual final path
+		// component instead of Hub's convention for bare names.
+		nameRepo = strings.TrimPrefix(nameRepo, "library/")
+	}
+	if candidateRepo != nameRepo && !strings.HasSuffix(candidateRepo, "/"+nameRepo) {
+		return false
+	}
+
+	if tagged, ok := nameRef.(reference.Tagged); ok {
+		candidateTagged, ok := candidateRef.(reference.Tagged)
+		if !ok || candidateTagged.Tag() != tagged.Tag() {
+			return false
+		}
+	}
+	if digested, ok := nameRef.(reference.Digested); ok {
+		candidateDigested, ok := candidateRef.(reference.Digested)
+		if !ok || candidateDigested.Digest() != digested.Digest() {
+			return false
+		}
+	}
+	return true
+}
+
+func namesMatch(names []string, name string) bool {
+	for _, candidate := range names {
+		if Matches(candidate, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// shortNameIsAmbiguous reports whether name, a bare repository-local name
+// with no "/" of its own, also matches an image in local storage other
+// than matchedID. A name that contains a "/" is not checked and is never
+// reported as ambiguous.
+func (r *Runtime) shortNameIsAmbiguous(name, matchedID string) (bool, error) {
+	if strings.Contains(name, "/") {
+		return false, nil
+	}
+	images, err := r.store.Images()
+	if err != nil {
+		return false, errors.Wrapf(err, "error listing local images")
+	}
+	for _, candidate := range images {
+		if candidate.ID == matchedID {
+			continue
+		}
+		if namesMatch(candidate.Names, name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// LookupImage looks for name only in local storage, without consulting any
+// registry, and accepts the image it finds only if one of its recorded
+// names passes the repository-boundary check of Matches. If
+// options.Platform is set, an image found
+// locally that was built for a different platform is treated as not found,
+// so that a caller asking for, say, linux/arm64 doesn't silently get back
+// whatever platform happens to be stored under that name.
+func (r *Runtime) LookupImage(ctx context.Context, name string, options LookupOptions) (*Image, error) {
+	img, err := r.store.Image(name)
+	if err != nil {
+		return nil, errors.Wrapf(ErrNoSuchImage, "%q: %v", name, err)
+	}
+	if !namesMatch(img.Names, name) {
+		return nil, errors.Wrapf(ErrNoSuchImage, "%q did not match any of the recorded names of %q", name, img.ID)
+	}
+	if ambiguous, err := r.shortNameIsAmbiguous(name, img.ID); err != nil {
+		return nil, err
+	} else if ambiguous {
+		return nil, errors.Wrapf(ErrShortNameAmbiguous, "%q matches images from more than one repository in local storage", name)
+	}
+	result := r.newImage(img)
+	if options.Platform != nil {
+		matches, err := r.imageMatchesPlatform(ctx, img, *options.Platform)
+		if err != nil {
+			return nil, err
+		}
+		if !matches {
+			return nil, errors.Wrapf(ErrNoSuchImage, "%q was found locally, but not for the requested %s/%s", name, options.Platform.OS, options.Platform.Arch)
+		}
+		result.Platform = *options.Platform
+	}
+	return result, nil
+}
+
+// imageMatchesPlatform reports whether img's OS and architecture (when
+// platform specifies them) match the image actually stored under img.ID.
+func (r *Runtime) imageMatchesPlatform(ctx context.Context, img *storage.Image, platform Platform) (bool, error) {
+	ref, err := is.Transport.ParseStoreReference(r.store, img.ID)
+	if err != nil {
+		return false, errors.Wrapf(err, "error parsing reference to image %q", img.ID)
+	}
+	localImg, err := ref.NewImage(ctx, r.systemContext)
+	if err != nil {
+		return false, errors.Wrapf(err, "error reading local image %q", img.ID)
+	}
+	defer localImg.Close()
+	inspect, err := localImg.Inspect(ctx)
+	if err != nil {
+		return false, errors.Wrapf(err, "error inspecting local image %q", img.ID)
+	}
+	if platform.OS != "" && inspect.Os != platform.OS {
+		return false, nil
+	}
+	if platform.Arch != "" && inspect.Architecture != platform.Arch {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Pull fetches name from a registry (or any other containers/image
+// transport) and records it in local storage, regardless of whether a
+// local copy already exists.
+func (r *Runtime) Pull(ctx context.Context, name string, options PullOptions) (*Image, error) {
+	srcRef, err := alltransports.ParseImageName(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing image name %q", name)
+	}
+	img, err := r.pullFromReference(ctx, srcRef, options)
+	if err != nil {
+		r.reportf(options.Report, name, "pull failed", err)
+		return nil, err
+	}
+	r.reportf(options.Report, name, "pulled", nil)
+	return img, nil
+}
+
+// pullFromReference retries pullOnce according to options.RetryPolicy,
+// classifying each failure as it comes in: a Terminal error (bad
+// credentials, an unknown manifest, a signature failure) aborts
+// immediately, while a Retryable one (a network timeout, a 5xx, a 429)
+// backs off and tries again until the policy's MaxRetries or MaxElapsed is
+// reached.
+func (r *Runtime) pullFromReference(ctx context.Context, srcRef types.ImageReference, options PullOptions) (*Image, error) {
+	policy := options.RetryPolicy.normalized()
+	imageName := transports.ImageName(srcRef)
+	start := time.Now()
+	var delay time.Duration
+
+	for attempt := 1; ; attempt++ {
+		img, pullErr := r.pullOnce(ctx, srcRef, options)
+		if pullErr == nil {
+			return img, nil
+		}
+
+		decision := classifyPullAttemptError(pullErr)
+		if !decision.retryable || attempt > policy.MaxRetries {
+			return nil, pullErr
+		}
+		if policy.MaxElapsed > 0 && time.Since(start) >= policy.MaxElapsed {
+			return nil, pullErr
+		}
+
+		delay = policy.nextDelay(delay)
+		if decision.retryAfter > delay {
+			delay = decision.retryAfter
+		}
+
+		message := fmt.Sprintf("Retrying pull of %q (attempt %d/%d) after %s: %v", imageName, attempt+1, policy.MaxRetries+1, delay, pullErr)
+		if options.ReportWriter != nil {
+			fmt.Fprintln(options.ReportWriter, message)
+		}
+		r.reportf(options.Report, imageName, message, pullErr)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (r *Runtime) pullOnce(ctx context.Context, srcRef types.ImageReference, options PullOptions) (*Image, error) {
+	destName, err := localImageNameForReference(srcRef)
+	if err != nil {
+		return nil, err
+	}
+	destRef, err := is.Transport.ParseStoreReference(r.store, destName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing reference to image %q", destName)
+	}
+
+	policy, err := signature.DefaultPolicy(r.systemContext)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error obtaining default signature policy")
+	}
+	policyContext, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error building signature policy context")
+	}
+	defer policyContext.Destroy()
+
+	pullRef := srcRef
+	if options.BlobDirectory != "" {
+		pullRef, err = blobcache.NewBlobCache(srcRef, options.BlobDirectory, types.PreserveOriginal)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error wrapping source image %q in blob cache", transports.ImageName(srcRef))
+		}
+	}
+
+	sourceCtx := platformSystemContext(r.systemContext, options.Platform)
+	if _, err := cp.Image(ctx, policyContext, destRef, pullRef, &cp.Options{
+		ReportWriter:   options.ReportWriter,
+		SourceCtx:      sourceCtx,
+		DestinationCtx: r.systemContext,
+	}); err != nil {
+		return nil, classifyPullError(srcRef, err)
+	}
+
+	img, err := is.Transport.GetStoreImage(r.store, destRef)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error locating image %q in local storage", transports.ImageName(destRef))
+	}
+	result := r.newImage(img)
+	result.Platform = platformOrDefault(options.Platform, r.systemContext)
+	return result, nil
+}
+
+func localImageNameForReference(srcRef types.ImageReference) (string, error) {
+	if srcRef.Transport().Name() == util.DefaultTransport {
+		named := srcRef.DockerReference()
+		if named == nil {
+			return "", errors.Errorf("reference %q has no name", transports.ImageName(srcRef))
+		}
+		return named.String(), nil
+	}
+	return transports.ImageName(srcRef), nil
+}
+
+// isRemoteNewer reports whether the image named by srcRef differs from
+// localImg, choosing the manifest list instance for platform (or the host's
+// platform, if platform is nil) when srcRef names a multi-arch image.
+// Registries may omit or reset Created, reproducible builds often pin it to
+// the epoch, and a manifest list doesn't carry a meaningful Created value
+// for the instance that will actually be used, so the comparison is based
+// on manifest digests whenever both are available; Created is only a
+// fallback.
+func (r *Runtime) isRemoteNewer(ctx context.Context, srcRef types.ImageReference, localImg *Image, platform *Platform) (bool, error) {
+	sysCtx := platformSystemContext(r.systemContext, platform)
+
+	remoteSrc, err := srcRef.NewImageSource(ctx, sysCtx)
+	if err != nil {
+		return false, errors.Wrapf(err, "error reading remote image %q", transports.ImageName(srcRef))
+	}
+	defer remoteSrc.Close()
+
+	manifestBytes, manifestType, err := remoteSrc.GetManifest(ctx, nil)
+	if err != nil {
+		return false, errors.Wrapf(err, "error reading manifest for %q", transports.ImageName(srcRef))
+	}
+
+	remoteDigest, digestErr := manifest.Digest(manifestBytes)
+	if digestErr == nil && manifest.MIMETypeIsMultiImage(manifestType) {
+		list, err := manifest.ListFromBlob(manifestBytes, manifestType)
+		if err != nil {
+			return false, errors.Wrapf(err, "error parsing manifest for %q as a list", transports.ImageName(srcRef))
+		}
+		instanceDigest, err := list.ChooseInstance(sysCtx)
+		if err != nil {
+			return false, errors.Wrapf(err, "error finding an appropriate image in manifest list %q", transports.ImageName(srcRef))
+		}
+		remoteDigest = instanceDigest
+	}
+
+	if digestErr == nil && localImg.Digest != "" {
+		return remoteDigest != localImg.Digest, nil
+	}
+
+	repoImage, err := srcRef.NewImage(ctx, sysCtx)
+	if err != nil {
+		return false, errors.Wrapf(err, "error reading remote image %q", transports.ImageName(srcRef))
+	}
+	defer repoImage.Close()
+	inspect, err := repoImage.Inspect(ctx)
+	if err != nil {
+		return false, errors.Wrapf(err, "error inspecting remote image %q", transports.ImageName(srcRef))
+	}
+	if inspect.Created == nil {
+		return false, nil
+	}
+	return *inspect.Created != localImg.Created, nil
+}
+
+// Resolve finds the local or remote image that best matches name,
+// consulting the registries implied by name and the Runtime's
+// SystemContext, and pulling it if options.PullPolicy requires it. It
+// replaces the candidate loop that buildah's own resolveImage used to
+// open-code: the short-name/search-registry candidate generation, failure
+// aggregation, and pull-policy branching all live here so that other
+// callers - such as CRI-O's image service - can reuse them directly.
+func (r *Runtime) Resolve(ctx context.Context, name string, options ResolveOptions) (*Image, error) {
+	type failure struct {
+		candidate string
+		err       error
+	}
+
+	candidates, transport, searchRegistriesWereUsedButEmpty, err := util.ResolveName(name, options.Registry, r.systemContext, r.store)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing reference to image %q", name)
+	}
+
+	pullOptions := PullOptions{
+		Platform:      options.Platform,
+		BlobDirectory: options.BlobDirectory,
+		ReportWriter:  options.ReportWriter,
+		Report:        options.Report,
+		RetryPolicy:   options.RetryPolicy,
+	}
+
+	var failures []failure
+	for _, candidate := range candidates {
+		if transport == "" {
+			img, err := r.LookupImage(ctx, candidate, LookupOptions{Platform: options.Platform})
+			if err != nil {
+				r.reportf(options.Report, candidate, "not found locally", err)
+				failures = append(failures, failure{candidate, err})
+				continue
+			}
+			r.reportf(options.Report, candidate, "resolved locally", nil)
+			return img, nil
+		}
+
+		trans := transport
+		if transport != util.DefaultTransport {
+			trans = trans + ":"
+		}
+		srcRef, err := alltransports.ParseImageName(trans + candidate)
+		if err != nil {
+			err = errors.Wrapf(err, "error parsing attempted image name %q", trans+candidate)
+			r.reportf(options.Report, candidate, "invalid image name", err)
+			failures = append(failures, failure{candidate, err})
+			continue
+		}
+
+		if options.PullPolicy == PullAlways {
+			img, err := r.pullFromReference(ctx, srcRef, pullOptions)
+			if err != nil {
+				r.reportf(options.Report, candidate, "pull failed", err)
+				failures = append(failures, failure{candidate, err})
+				continue
+			}
+			r.reportf(options.Report, candidate, "pulled", nil)
+			return img, nil
+		}
+
+		destName, err := localImageNameForReference(srcRef)
+		if err != nil {
+			return nil, err
+		}
+		destRef, err := is.Transport.ParseStoreReference(r.store, destName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing reference to image %q", destName)
+		}
+
+		if options.PullPolicy == PullIfNewer {
+			if storedImg, err := is.Transport.GetStoreImage(r.store, destRef); err == nil {
+				img := r.newImage(storedImg)
+				newer, err := r.isRemoteNewer(ctx, srcRef, img, options.Platform)
+				if err != nil {
+					logrus.Debugf("error comparing remote and local images for %q, assuming local image is current: %v", transports.ImageName(srcRef), err)
+					newer = false
+				}
+				if !newer {
+					r.reportf(options.Report, candidate, "local image is current", nil)
+					return img, nil
+				}
+			}
+		} else {
+			storedImg, err := is.Transport.GetStoreImage(r.store, destRef)
+			if err == nil {
+				r.reportf(options.Report, candidate, "resolved locally", nil)
+				return r.newImage(storedImg), nil
+			}
+			if errors.Cause(err) == storage.ErrImageUnknown && options.PullPolicy == PullNever {
+				err = errors.Wrapf(ErrNoSuchImage, "%q", transports.ImageName(destRef))
+				r.reportf(options.Report, candidate, "not found locally", err)
+				failures = append(failures, failure{candidate, err})
+				continue
+			}
+		}
+
+		img, err := r.pullFromReference(ctx, srcRef, pullOptions)
+		if err != nil {
+			r.reportf(options.Report, candidate, "pull failed", err)
+			failures = append(failures, failure{candidate, err})
+			continue
+		}
+		r.reportf(options.Report, candidate, "pulled", nil)
+		return img, nil
+	}
+
+	if len(failures) != len(candidates) {
+		return nil, errors.Errorf("internal error: %d candidates (%#v) vs. %d failures (%#v)", len(candidates), candidates, len(failures), failures)
+	}
+
+	switch len(failures) {
+	case 0:
+		if searchRegistriesWereUsedButEmpty {
+			return nil, errors.Wrapf(ErrNoSuchImage, "%q is a short name and no search registries are defined", name)
+		}
+		return nil, errors.Wrapf(ErrNoSuchImage, "no pull candidates were available for %q", name)
+
+	case 1:
+		err := failures[0].err
+		if failures[0].candidate != name {
+			err = errors.Wrapf(err, "while pulling %q as %q", name, failures[0].candidate)
+		}
+		if searchRegistriesWereUsedButEmpty {
+			err = errors.Wrapf(err, "(image name %q is a short name and no search registries are defined)", name)
+		}
+		return nil, err
+
+	default:
+		e := fmt.Sprintf("the following failures happened while trying to pull image specified by %q:", name)
+		for _, f := range failures {
+			e += fmt.Sprintf("\n* %q: %s", f.candidate, f.err.Error())
+		}
+		if searchRegistriesWereUsedButEmpty {
+			e += fmt.Sprintf("\n(image name %q is a short name and no search registries are defined)", name)
+		}
+		return nil, errors.Wrap(ErrNoSuchImage, e)
+	}
+}
+
+func (r *Runtime) newImage(img *storage.Image) *Image {
+	result := &Image{Image: img}
+	if manifestBytes, err := r.store.ImageBigData(img.ID, "manifest"); err == nil {
+		if d, err := manifest.Digest(manifestBytes); err == nil {
+			result.Digest = d
+		}
+	}
+	result.Platform = platformOrDefault(nil, r.systemContext)
+	result.ParentID, result.Children = r.parentAndChildren(img)
+	result.NamesHistory = img.NamesHistory
+	return result
+}
+
+func (r *Runtime) parentAndChildren(img *storage.Image) (parentID string, children []string) {
+	images, err := r.store.Images()
+	if err != nil {
+		return "", nil
+	}
+	layer, err := r.store.Layer(img.TopLayer)
+	if err != nil {
+		return "", nil
+	}
+	for _, candidate := range images {
+		if candidate.ID == img.ID {
+			continue
+		}
+		if candidate.TopLayer == layer.Parent {
+			parentID = candidate.ID
+		}
+		if candidateLayer, err := r.store.Layer(candidate.TopLayer); err == nil && candidateLayer.Parent == img.TopLayer {
+			children = append(children, candidate.ID)
+		}
+	}
+	return parentID, children
+}
+
+func platformOrDefault(p *Platform, sys *types.SystemContext) Platform {
+	if p != nil {
+		return *p
+	}
+	platform := Platform{OS: "linux"}
+	if sys != nil {
+		if sys.OSChoice != "" {
+			platform.OS = sys.OSChoice
+		}
+		if sys.ArchitectureChoice != "" {
+			platform.Arch = sys.ArchitectureChoice
+		}
+		if sys.VariantChoice != "" {
+			platform.Variant = sys.VariantChoice
+		}
+	}
+	return platform
+}
+
+// platformSystemContext returns sys unchanged if platform is nil, or a copy
+// of sys with its OS/architecture/variant overridden to platform otherwise,
+// so that a single Runtime with a host-default SystemContext can still
+// honor a per-call platform override when choosing a manifest list instance
+// or inspecting an image.
+func platformSystemContext(sys *types.SystemContext, platform *Platform) *types.SystemContext {
+	if platform == nil {
+		return sys
+	}
+	var copied types.SystemContext
+	if sys != nil {
+		copied = *sys
+	}
+	copied.OSChoice = platform.OS
+	copied.ArchitectureChoice = platform.Arch
+	copied.VariantChoice = platform.Variant
+	return &copied
+}
+
+// classifyPullError wraps a failed copy attempt with the name of the image
+// that was being pulled, so failure messages read the same way the rest of
+// this package's errors do.
+func classifyPullError(srcRef types.ImageReference, err error) error {
+	return errors.Wrapf(err, "error pulling image %q", transports.ImageName(srcRef))
+}
@@ -0,0 +1,99 @@
+package imageresolver
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// fakeImageSource is a minimal types.ImageSource that only serves a fixed
+// manifest, which is all isRemoteNewer needs from it.
+type fakeImageSource struct {
+	ref      types.ImageReference
+	manifest []byte
+}
+
+func (f *fakeImageSource) Reference() types.ImageReference { return f.ref }
+func (f *fakeImageSource) Close() error                    { return nil }
+func (f *fakeImageSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	return f.manifest, manifestMIMEType, nil
+}
+func (f *fakeImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	panic("not needed by isRemoteNewer")
+}
+func (f *fakeImageSource) HasThreadSafeGetBlob() bool { return false }
+func (f *fakeImageSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
+	panic("not needed by isRemoteNewer")
+}
+func (f *fakeImageSource) LayerInfosForCopy(ctx context.Context, instanceDigest *digest.Digest) ([]types.BlobInfo, error) {
+	panic("not needed by isRemoteNewer")
+}
+
+// fakeImageReference is a minimal types.ImageReference whose only job is to
+// hand back a fakeImageSource; isRemoteNewer never touches the rest of the
+// interface as long as the local image already carries a digest.
+type fakeImageReference struct {
+	manifest []byte
+}
+
+func (f *fakeImageReference) Transport() types.ImageTransport         { return nil }
+func (f *fakeImageReference) StringWithinTransport() string           { return "fake" }
+func (f *fakeImageReference) DockerReference() reference.Named        { return nil }
+func (f *fakeImageReference) PolicyConfigurationIdentity() string     { return "" }
+func (f *fakeImageReference) PolicyConfigurationNamespaces() []string { return nil }
+func (f *fakeImageReference) NewImage(ctx context.Context, sys *types.SystemContext) (types.ImageCloser, error) {
+	panic("not needed when the local image already has a digest")
+}
+func (f *fakeImageReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	return &fakeImageSource{ref: f, manifest: f.manifest}, nil
+}
+func (f *fakeImageReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	panic("not needed by isRemoteNewer")
+}
+func (f *fakeImageReference) DeleteImage(ctx context.Context, sys *types.SystemContext) error {
+	panic("not needed by isRemoteNewer")
+}
+
+const manifestMIMEType = "application/vnd.docker.distribution.manifest.v2+json"
+
+func manifestWithConfigDigest(t *testing.T, configDigest string) []byte {
+	t.Helper()
+	return []byte(`{"schemaVersion":2,"mediaType":"` + manifestMIMEType + `","config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":1,"digest":"` + configDigest + `"}}`)
+}
+
+func TestIsRemoteNewerComparesManifestDigests(t *testing.T) {
+	r := NewRuntime(nil, nil)
+
+	remoteManifest := manifestWithConfigDigest(t, "sha256:1111111111111111111111111111111111111111111111111111111111111111")
+	remoteDigest := digest.FromBytes(remoteManifest)
+
+	t.Run("same digest is not newer", func(t *testing.T) {
+		localImg := &Image{Image: nil, Digest: remoteDigest}
+		srcRef := &fakeImageReference{manifest: remoteManifest}
+
+		newer, err := r.isRemoteNewer(context.Background(), srcRef, localImg, nil)
+		if err != nil {
+			t.Fatalf("isRemoteNewer: %v", err)
+		}
+		if newer {
+			t.Errorf("isRemoteNewer = true, want false for a matching digest")
+		}
+	})
+
+	t.Run("different digest is newer", func(t *testing.T) {
+		localImg := &Image{Image: nil, Digest: digest.Digest("sha256:2222222222222222222222222222222222222222222222222222222222222222")}
+		srcRef := &fakeImageReference{manifest: remoteManifest}
+
+		newer, err := r.isRemoteNewer(context.Background(), srcRef, localImg, nil)
+		if err != nil {
+			t.Fatalf("isRemoteNewer: %v", err)
+		}
+		if !newer {
+			t.Errorf("isRemoteNewer = false, want true for a differing digest")
+		}
+	})
+}
@@ -0,0 +1,157 @@
+package imageresolver
+
+import (
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy controls the backoff used between pull attempts.
+type RetryPolicy struct {
+	// MaxRetries is the number of attempts allowed after the first.
+	MaxRetries int
+	// InitialDelay is the delay before the first retry.
+	InitialDelay time.Duration
+	// MaxDelay caps the computed backoff delay between any two attempts.
+	// A longer Retry-After from the server still replaces it.
+	MaxDelay time.Duration
+	// Multiplier scales the previous delay on each subsequent retry.
+	Multiplier float64
+	// Jitter, if true, picks each delay randomly between InitialDelay
+	// and the multiplied value instead of using it directly, so that
+	// many callers retrying the same image don't all wake up in
+	// lockstep.
+	Jitter bool
+	// MaxElapsed bounds the total time spent retrying, regardless of
+	// MaxRetries.
+	MaxElapsed time.Duration
+}
+
+// DefaultRetryPolicy builds a fixed-delay RetryPolicy equivalent to the
+// flat MaxRetries/RetryDelay behavior that pulls used before backoff was
+// introduced, so that callers which only set those two fields keep
+// behaving the same way.
+func DefaultRetryPolicy(maxRetries int, delay time.Duration) RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:   maxRetries,
+		InitialDelay: delay,
+		MaxDelay:     delay,
+		Multiplier:   1,
+	}
+}
+
+func (p RetryPolicy) normalized() RetryPolicy {
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.InitialDelay < 0 {
+		p.InitialDelay = 0
+	}
+	if p.MaxDelay < p.InitialDelay {
+		p.MaxDelay = p.InitialDelay
+	}
+	return p
+}
+
+// nextDelay returns the delay to wait before the next attempt, given the
+// delay that was used before the previous one (zero before the first
+// retry). With Jitter set, it implements decorrelated jitter: the result
+// is a random value between InitialDelay and previous*Multiplier, rather
+// than that product directly, which avoids many retriers converging on
+// the same cadence.
+func (p RetryPolicy) nextDelay(previous time.Duration) time.Duration {
+	p = p.normalized()
+	delay := time.Duration(float64(previous) * p.Multiplier)
+	if delay < p.InitialDelay {
+		delay = p.InitialDelay
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter && delay > p.InitialDelay {
+		delay = p.InitialDelay + time.Duration(rand.Int63n(int64(delay-p.InitialDelay+1)))
+	}
+	return delay
+}
+
+// retryDecision is the result of classifying a failed pull attempt.
+type retryDecision struct {
+	// retryable is false for failures that a retry cannot fix, such as
+	// authentication, a missing manifest, or a signature policy
+	// violation.
+	retryable bool
+	// retryAfter is the minimum delay the server asked for, from a 429
+	// response's Retry-After, or zero if none was given.
+	retryAfter time.Duration
+}
+
+var retryAfterPattern = regexp.MustCompile(`(?i)retry-after[:= ]+(\d+)`)
+
+func retryAfterFromError(err error) time.Duration {
+	m := retryAfterPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	secs, convErr := strconv.Atoi(m[1])
+	if convErr != nil {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// classifyPullAttemptError decides whether a failed pull attempt is worth
+// retrying. Authentication failures, missing manifests, and signature
+// failures are Terminal: a retry would just reproduce the same error.
+// Network timeouts, 5xx responses, and 429s (whose Retry-After we honor
+// when present) are Retryable.
+func classifyPullAttemptError(err error) retryDecision {
+	if err == nil {
+		return retryDecision{}
+	}
+
+	cause := errors.Cause(err)
+
+	if ec, ok := cause.(errcode.ErrorCoder); ok {
+		switch ec.ErrorCode() {
+		case errcode.ErrorCodeUnauthorized, errcode.ErrorCodeDenied,
+			v2.ErrorCodeManifestUnknown, v2.ErrorCodeManifestInvalid, v2.ErrorCodeNameUnknown:
+			return retryDecision{retryable: false}
+		case errcode.ErrorCodeTooManyRequests:
+			return retryDecision{retryable: true, retryAfter: retryAfterFromError(err)}
+		}
+	}
+
+	if netErr, ok := cause.(net.Error); ok && netErr.Timeout() {
+		return retryDecision{retryable: true}
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "unauthorized"),
+		strings.Contains(msg, "authentication required"),
+		strings.Contains(msg, "manifest unknown"),
+		strings.Contains(msg, "signature"):
+		return retryDecision{retryable: false}
+	case strings.Contains(msg, "too many requests"):
+		return retryDecision{retryable: true, retryAfter: retryAfterFromError(err)}
+	case strings.Contains(msg, "timeout"),
+		strings.Contains(msg, "connection reset"),
+		strings.Contains(msg, "service unavailable"),
+		strings.Contains(msg, "internal server error"),
+		strings.Contains(msg, "eof"):
+		return retryDecision{retryable: true}
+	}
+
+	// An unrecognized failure is more likely a transient one than a new
+	// kind of permanent failure, and MaxRetries/MaxElapsed bound how
+	// long we'll keep retrying a failure that turns out to be
+	// permanent after all.
+	return retryDecision{retryable: true}
+}
@@ -0,0 +1,102 @@
+package imageresolver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/pkg/errors"
+)
+
+func TestRetryPolicyNextDelayGrowsAndCaps(t *testing.T) {
+	policy := RetryPolicy{
+		InitialDelay: time.Second,
+		MaxDelay:     4 * time.Second,
+		Multiplier:   2,
+	}
+
+	cases := []struct {
+		previous time.Duration
+		want     time.Duration
+	}{
+		{0, time.Second},
+		{time.Second, 2 * time.Second},
+		{2 * time.Second, 4 * time.Second},
+		{4 * time.Second, 4 * time.Second}, // capped at MaxDelay
+	}
+	for _, c := range cases {
+		if got := policy.nextDelay(c.previous); got != c.want {
+			t.Errorf("nextDelay(%s) = %s, want %s", c.previous, got, c.want)
+		}
+	}
+}
+
+func TestRetryPolicyNextDelayJitterStaysInBounds(t *testing.T) {
+	policy := RetryPolicy{
+		InitialDelay: time.Second,
+		MaxDelay:     8 * time.Second,
+		Multiplier:   2,
+		Jitter:       true,
+	}
+
+	for i := 0; i < 50; i++ {
+		got := policy.nextDelay(4 * time.Second)
+		if got < policy.InitialDelay || got > 8*time.Second {
+			t.Fatalf("nextDelay with jitter = %s, want within [%s, %s]", got, policy.InitialDelay, 8*time.Second)
+		}
+	}
+}
+
+func TestRetryAfterFromError(t *testing.T) {
+	cases := []struct {
+		msg  string
+		want time.Duration
+	}{
+		{"429 Too Many Requests: retry-after: 5", 5 * time.Second},
+		{"too many requests, Retry-After=30", 30 * time.Second},
+		{"connection reset by peer", 0},
+	}
+	for _, c := range cases {
+		if got := retryAfterFromError(errors.New(c.msg)); got != c.want {
+			t.Errorf("retryAfterFromError(%q) = %s, want %s", c.msg, got, c.want)
+		}
+	}
+}
+
+// fakeTimeoutError is a minimal net.Error that reports itself as a timeout.
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string   { return "i/o timeout" }
+func (fakeTimeoutError) Timeout() bool   { return true }
+func (fakeTimeoutError) Temporary() bool { return true }
+
+func TestClassifyPullAttemptError(t *testing.T) {
+	cases := []struct {
+		name           string
+		err            error
+		wantRetryable  bool
+		wantRetryAfter time.Duration
+	}{
+		{"nil error", nil, false, 0},
+		{"unauthorized by code", errcode.ErrorCodeUnauthorized.WithMessage("denied"), false, 0},
+		{"too many requests by code", errcode.ErrorCodeTooManyRequests.WithMessage("slow down"), true, 0},
+		{"wrapped network timeout", errors.Wrap(fakeTimeoutError{}, "error reading response"), true, 0},
+		{"unauthorized by message", errors.New("authentication required to pull"), false, 0},
+		{"manifest unknown by message", errors.New("manifest unknown: not found"), false, 0},
+		{"too many requests by message with retry-after", errors.New("too many requests, retry-after: 10"), true, 10 * time.Second},
+		{"service unavailable by message", errors.New("503 service unavailable"), true, 0},
+		{"unrecognized error", errors.New("something went sideways"), true, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			decision := classifyPullAttemptError(c.err)
+			if decision.retryable != c.wantRetryable {
+				t.Errorf("retryable = %v, want %v", decision.retryable, c.wantRetryable)
+			}
+			if decision.retryAfter != c.wantRetryAfter {
+				t.Errorf("retryAfter = %s, want %s", decision.retryAfter, c.wantRetryAfter)
+			}
+		})
+	}
+}